@@ -2,9 +2,12 @@ package nameserver
 
 import (
 	"container/heap"
+	"context"
 	"errors"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	. "github.com/weaveworks/weave/common"
+	"hash/fnv"
 	"math"
 	"math/rand"
 	"sync"
@@ -16,13 +19,18 @@ var (
 	errCouldNotResolve = errors.New("Could not resolve")
 	errTimeout         = errors.New("Timeout while waiting for resolution")
 	errNoLocalReplies  = errors.New("No local replies")
+	errNegativeReply   = errors.New("Negative reply from cache")
 )
 
 const (
 	defPendingTimeout int = 5 // timeout for a resolution
 )
 
-const nullTTL = 0	// a null TTL
+const nullTTL = 0 // a null TTL
+
+// staleReplyTTL is the TTL handed out on answers served stale-while-revalidate: small enough
+// that a client won't hang on to a possibly-outdated answer for long.
+const staleReplyTTL uint32 = 1
 
 type entryStatus uint8
 
@@ -33,6 +41,7 @@ const (
 
 const (
 	CacheNoLocalReplies uint8 = 1 << iota // not found in local network (stored in the cache so we skip another local lookup or some time)
+	CacheNegative                         // a cached NXDOMAIN/SERVFAIL answer (RFC 2308 negative caching)
 )
 
 // shuffleAnswers reorders answers for very basic load balancing
@@ -64,6 +73,8 @@ type cacheEntry struct {
 	putTime    time.Time
 
 	index int // for fast lookups in the heap
+
+	ready chan struct{} // closed exactly once, when the entry moves from stPending to stResolved
 }
 
 func newCacheEntry(question *dns.Question, now time.Time) *cacheEntry {
@@ -72,6 +83,7 @@ func newCacheEntry(question *dns.Question, now time.Time) *cacheEntry {
 		validUntil: now.Add(time.Second * time.Duration(defPendingTimeout)),
 		question:   *question,
 		index:      -1,
+		ready:      make(chan struct{}),
 	}
 
 	return e
@@ -88,6 +100,24 @@ func (e *cacheEntry) getReply(request *dns.Msg, maxLen int, now time.Time) (*dns
 		return nil, nil
 	}
 
+	return e.buildReply(request, maxLen, now, 0)
+}
+
+// getStaleReply is like getReply but for an already-expired entry that is still within its
+// serve-stale window: the normal TTL bookkeeping is skipped and every answer TTL is clamped
+// to floorTTL instead.
+func (e *cacheEntry) getStaleReply(request *dns.Msg, maxLen int, now time.Time, floorTTL uint32) (*dns.Msg, error) {
+	if e.Status != stResolved {
+		return nil, nil
+	}
+
+	return e.buildReply(request, maxLen, now, floorTTL)
+}
+
+// buildReply copies the stored reply for request, adjusting TTLs either by subtracting the
+// time elapsed since it was stored (floorTTL == 0) or by clamping every TTL to floorTTL
+// (used when serving a stale answer).
+func (e *cacheEntry) buildReply(request *dns.Msg, maxLen int, now time.Time, floorTTL uint32) (*dns.Msg, error) {
 	if e.Flags&CacheNoLocalReplies != 0 {
 		return nil, errNoLocalReplies
 	}
@@ -101,16 +131,11 @@ func (e *cacheEntry) getReply(request *dns.Msg, maxLen int, now time.Time) (*dns
 	reply := e.reply.Copy()
 	reply.SetReply(request)
 
-	// adjust the TTLs
+	// adjust the TTLs on both the answer and, for cached negative replies, the SOA carried
+	// in the authority section
 	passedSecs := uint32(now.Sub(e.putTime).Seconds())
-	for _, rr := range reply.Answer {
-		hdr := rr.Header()
-		ttl := hdr.Ttl
-		if passedSecs < ttl {
-			hdr.Ttl = ttl - passedSecs
-		} else {
-			return nil, nil // it is expired: do not spend more time and return nil...
-		}
+	if !adjustTTLs(reply.Answer, passedSecs, floorTTL) || !adjustTTLs(reply.Ns, passedSecs, floorTTL) {
+		return nil, nil // it is expired: do not spend more time and return nil...
 	}
 
 	reply.Rcode = e.reply.Rcode
@@ -119,18 +144,44 @@ func (e *cacheEntry) getReply(request *dns.Msg, maxLen int, now time.Time) (*dns
 	// shuffle the values, etc...
 	reply.Answer = shuffleAnswers(reply.Answer)
 
+	if e.Flags&CacheNegative != 0 {
+		// still hand back the cached NXDOMAIN/SERVFAIL verbatim; errNegativeReply just lets
+		// the caller tell a negative cache hit apart from a positive one for its own policy
+		return reply, errNegativeReply
+	}
+
 	return reply, nil
 }
 
+// adjustTTLs rewrites the TTL of every record in rrs, either clamping it to floorTTL (used
+// when serving a stale answer) or decrementing it by passedSecs. It returns false if
+// floorTTL is 0 and a record has genuinely run out of TTL, meaning the caller must treat
+// the entry as expired.
+func adjustTTLs(rrs []dns.RR, passedSecs, floorTTL uint32) bool {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if floorTTL != 0 {
+			hdr.Ttl = floorTTL
+			continue
+		}
+		if passedSecs >= hdr.Ttl {
+			return false
+		}
+		hdr.Ttl -= passedSecs
+	}
+	return true
+}
+
 func (e cacheEntry) hasExpired(now time.Time) bool {
 	return e.validUntil.Before(now) || e.validUntil == now
 }
 
 // set the reply for the entry
 // returns True if the entry has changed the validUntil time
-func (e *cacheEntry) setReply(reply *dns.Msg, ttl int, flags uint8, now time.Time) bool {
+func (e *cacheEntry) setReply(reply *dns.Msg, ttl int, flags uint8, now time.Time, maxNegativeTTL uint32) bool {
 	var prevValidUntil time.Time
-	if e.Status == stResolved {
+	wasPending := e.Status != stResolved
+	if !wasPending {
 		if reply != nil {
 			Debug.Printf("[cache msgid %d] replacing response in cache", reply.MsgHdr.Id)
 		}
@@ -138,11 +189,17 @@ func (e *cacheEntry) setReply(reply *dns.Msg, ttl int, flags uint8, now time.Tim
 	}
 
 	e.Status = stResolved
-	e.Flags = flags
+	e.Flags = flags &^ CacheNegative // re-derived below; a stale bit from a previous reply must not stick
 	e.putTime = now
 
+	if reply != nil && isNegativeReply(reply) {
+		e.Flags |= CacheNegative
+	}
+
 	if ttl != nullTTL {
 		e.validUntil = now.Add(time.Second * time.Duration(ttl))
+	} else if reply != nil && isNegativeReply(reply) {
+		e.validUntil = now.Add(time.Second * time.Duration(negativeTTL(reply, maxNegativeTTL)))
 	} else if reply != nil {
 		// calculate the validUntil from the reply TTL
 		var minTTL uint32 = math.MaxUint32
@@ -160,9 +217,42 @@ func (e *cacheEntry) setReply(reply *dns.Msg, ttl int, flags uint8, now time.Tim
 		e.ReplyLen = reply.Len()
 	}
 
+	if wasPending {
+		close(e.ready) // wake up any Wait()ers exactly once
+	}
+
 	return (prevValidUntil != e.validUntil)
 }
 
+// isNegativeReply reports whether reply is a cacheable negative answer: NXDOMAIN or
+// SERVFAIL, per RFC 2308.
+func isNegativeReply(reply *dns.Msg) bool {
+	return reply.Rcode == dns.RcodeNameError || reply.Rcode == dns.RcodeServerFailure
+}
+
+// negativeTTL derives the TTL for a negative reply from the SOA record carried in its
+// authority section: the minimum of the SOA's MINIMUM field and its own TTL (RFC 2308),
+// capped by maxNegativeTTL. If no SOA is present, maxNegativeTTL is used as-is.
+func negativeTTL(reply *dns.Msg, maxNegativeTTL uint32) uint32 {
+	ttl := maxNegativeTTL
+	for _, rr := range reply.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl = soa.Minttl
+		if soa.Hdr.Ttl < ttl {
+			ttl = soa.Hdr.Ttl
+		}
+		break
+	}
+
+	if maxNegativeTTL > 0 && ttl > maxNegativeTTL {
+		ttl = maxNegativeTTL
+	}
+	return ttl
+}
+
 //////////////////////////////////////////////////////////////////////////////////////
 
 // An entriesPtrHeap is a min-heap of cache entries.
@@ -199,76 +289,242 @@ func (h *entriesPtrsHeap) Pop() interface{} {
 type cacheKey dns.Question
 type entries map[cacheKey]*cacheEntry
 
-// Cache is a thread-safe fixed capacity LRU cache.
-type Cache struct {
-	Capacity int
+// CacheOptions holds the cache knobs that go beyond a plain Capacity.
+type CacheOptions struct {
+	// ServeStaleFor, when non-zero, lets Get keep answering with an expired entry for up to
+	// this long after it falls out of validity, while a refresh is fetched in the background
+	// (RFC 8767-style serve-stale).
+	ServeStaleFor time.Duration
+
+	// Refresher re-resolves a question whose cached answer is being served stale.
+	// It must be set when ServeStaleFor is non-zero.
+	Refresher func(dns.Question) (*dns.Msg, int, error)
+
+	// MaxNegativeTTL caps how long a NXDOMAIN/SERVFAIL answer is cached for, regardless of
+	// what its SOA advertises (RFC 2308). Zero selects defMaxNegativeTTL.
+	MaxNegativeTTL time.Duration
+
+	// Shards sets the number of independently-locked shards the cache is split into. Zero
+	// selects defShardCount. Questions are distributed across shards by hashing their name,
+	// so unrelated lookups don't contend on the same lock or heap.
+	Shards int
+
+	// MetricsRegisterer, if non-nil, is used to register the cache's Prometheus collectors.
+	// Left nil, the collectors are still created and updated but never exposed, which is
+	// handy in tests that don't want to touch the default registry.
+	MetricsRegisterer prometheus.Registerer
+}
+
+// defMaxNegativeTTL is the default cap on negative-answer caching, per the 3-hour ceiling
+// recommended by RFC 2308.
+const defMaxNegativeTTL uint32 = 3 * 60 * 60
+
+// defShardCount is the default number of shards a Cache is split into.
+const defShardCount = 16
+
+// a cacheShard owns an independent slice of the cache's entries, each with its own lock and
+// eviction heap, so that lookups for unrelated names don't contend with each other.
+type cacheShard struct {
+	capacity int
 
 	entries  entries
 	entriesH entriesPtrsHeap // len(entriesH) <= len(entries), as pending entries can be in entries but not in entriesH
 	lock     sync.RWMutex
 }
 
+func newCacheShard(capacity int) *cacheShard {
+	s := &cacheShard{
+		capacity: capacity,
+		entries:  make(entries, capacity),
+	}
+	heap.Init(&s.entriesH)
+	return s
+}
+
+// cacheMetrics holds the Prometheus collectors instrumenting a Cache. They are always
+// created so the code paths that update them stay unconditional; they are only exposed to
+// a scraper if registered via CacheOptions.MetricsRegisterer.
+type cacheMetrics struct {
+	hits              prometheus.Counter
+	misses            prometheus.Counter
+	pending           prometheus.Counter
+	expiredEvictions  prometheus.Counter
+	capacityEvictions prometheus.Counter
+	size              prometheus.Gauge
+	entryAge          prometheus.Histogram
+}
+
+func newCacheMetrics(registerer prometheus.Registerer) *cacheMetrics {
+	m := &cacheMetrics{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_hits_total",
+			Help: "Number of cache lookups answered from a resolved entry.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_misses_total",
+			Help: "Number of cache lookups for a question with no entry at all.",
+		}),
+		pending: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_pending_total",
+			Help: "Number of cache lookups that found a resolution already in flight.",
+		}),
+		expiredEvictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_expired_evictions_total",
+			Help: "Number of entries removed from the cache because they expired.",
+		}),
+		capacityEvictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cache_capacity_evictions_total",
+			Help: "Number of entries evicted to make room under the configured capacity.",
+		}),
+		size: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cache_size",
+			Help: "Current number of entries held in the cache.",
+		}),
+		entryAge: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cache_entry_age_seconds",
+			Help:    "Age of a cache entry's previous value, observed each time it is replaced.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+	}
+
+	if registerer != nil {
+		registerer.MustRegister(m.hits, m.misses, m.pending, m.expiredEvictions,
+			m.capacityEvictions, m.size, m.entryAge)
+	}
+
+	return m
+}
+
+// Cache is a thread-safe fixed capacity LRU cache, split into shards to spread lock
+// contention across busy nameservers.
+type Cache struct {
+	Capacity       int
+	ServeStaleFor  time.Duration
+	MaxNegativeTTL uint32 // seconds; see CacheOptions.MaxNegativeTTL
+
+	shards  []*cacheShard
+	metrics *cacheMetrics
+
+	refresher   func(dns.Question) (*dns.Msg, int, error)
+	refreshing  map[cacheKey]struct{} // keys with a refresh already in flight
+	refreshLock sync.Mutex
+}
+
 // NewCache creates a cache of the given capacity
-func NewCache(capacity int) (*Cache, error) {
+func NewCache(capacity int, options CacheOptions) (*Cache, error) {
 	if capacity <= 0 {
 		return nil, errInvalidCapacity
 	}
+
+	maxNegativeTTL := uint32(options.MaxNegativeTTL.Seconds())
+	if maxNegativeTTL == 0 {
+		maxNegativeTTL = defMaxNegativeTTL
+	}
+
+	numShards := options.Shards
+	if numShards <= 0 {
+		numShards = defShardCount
+	}
+	if numShards > capacity {
+		numShards = capacity
+	}
+	shardCapacity := (capacity + numShards - 1) / numShards // round up
+
 	c := &Cache{
-		Capacity: capacity,
-		entries:  make(entries, capacity),
+		Capacity:       capacity,
+		ServeStaleFor:  options.ServeStaleFor,
+		MaxNegativeTTL: maxNegativeTTL,
+		shards:         make([]*cacheShard, numShards),
+		metrics:        newCacheMetrics(options.MetricsRegisterer),
+		refresher:      options.Refresher,
+		refreshing:     make(map[cacheKey]struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = newCacheShard(shardCapacity)
 	}
 
-	heap.Init(&c.entriesH)
 	return c, nil
 }
 
+// shardFor returns the shard responsible for question, chosen by hashing its name.
+func (c *Cache) shardFor(question dns.Question) *cacheShard {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(question.Name))
+	return c.shards[h.Sum64()%uint64(len(c.shards))]
+}
+
 // Clear removes all the entries in the cache
 func (c *Cache) Clear() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	c.entries = make(entries, c.Capacity)
-	heap.Init(&c.entriesH)
+	for _, s := range c.shards {
+		s.lock.Lock()
+		s.entries = make(entries, s.capacity)
+		heap.Init(&s.entriesH)
+		s.lock.Unlock()
+	}
+	c.metrics.size.Set(0)
 }
 
-// Purge removes the old elements in the cache
+// Purge removes the old elements in the cache. Entries that have expired but are still
+// within ServeStaleFor are left in place, since Get can still serve them while a refresh
+// is pending. Shards are purged independently, so a purge of one shard never stalls
+// queries hitting another.
 func (c *Cache) Purge(now time.Time) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	for i, entry := range c.entriesH {
-		if entry.hasExpired(now) {
-			heap.Remove(&c.entriesH, i)
-			delete(c.entries, cacheKey(entry.question))
-		} else {
-			return // all remaining entries must be still valid...
+	for _, s := range c.shards {
+		s.purge(now, c.ServeStaleFor, c.metrics)
+	}
+}
+
+func (s *cacheShard) purge(now time.Time, serveStaleFor time.Duration, metrics *cacheMetrics) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.entriesH) > 0 {
+		entry := s.entriesH[0] // the heap root is always the entry with the lowest validUntil
+		if !entry.hasExpired(now) {
+			return // the root is still valid, so every other entry must be too
 		}
+		if serveStaleFor > 0 && now.Sub(entry.validUntil) < serveStaleFor {
+			// the root, being the lowest validUntil in the whole heap, is also the entry
+			// that has been expired the longest; if it's still within its serve-stale
+			// window, every other entry is too, so there is nothing left to purge here
+			return
+		}
+		heap.Remove(&s.entriesH, 0)
+		delete(s.entries, cacheKey(entry.question))
+		metrics.expiredEvictions.Inc()
+		metrics.size.Dec()
 	}
 }
 
 // Add adds a reply to the cache.
 func (c *Cache) Put(request *dns.Msg, reply *dns.Msg, ttl int, flags uint8, now time.Time) int {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
 	question := request.Question[0]
+	s := c.shardFor(question)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	key := cacheKey(question)
-	ent, found := c.entries[key]
+	ent, found := s.entries[key]
 	if found {
-		updated := ent.setReply(reply, ttl, flags, now)
+		c.observeReplacedAge(ent, now)
+		updated := ent.setReply(reply, ttl, flags, now, c.MaxNegativeTTL)
 		if updated {
-			heap.Fix(&c.entriesH, ent.index)
+			heap.Fix(&s.entriesH, ent.index)
 		}
 	} else {
 		// If we will add a new item and the capacity has been exceeded, make some room...
-		if len(c.entriesH) >= c.Capacity {
-			lowestEntry := heap.Pop(&c.entriesH).(*cacheEntry)
-			delete(c.entries, cacheKey(lowestEntry.question))
+		if len(s.entriesH) >= s.capacity {
+			lowestEntry := heap.Pop(&s.entriesH).(*cacheEntry)
+			delete(s.entries, cacheKey(lowestEntry.question))
+			c.metrics.capacityEvictions.Inc()
+			c.metrics.size.Dec()
 		}
 		ent = newCacheEntry(&question, now)
-		ent.setReply(reply, ttl, flags, now)
-		heap.Push(&c.entriesH, ent)
-		c.entries[key] = ent
+		ent.setReply(reply, ttl, flags, now, c.MaxNegativeTTL)
+		heap.Push(&s.entriesH, ent)
+		s.entries[key] = ent
+		c.metrics.size.Inc()
 	}
 	return ent.ReplyLen
 }
@@ -277,47 +533,174 @@ func (c *Cache) Put(request *dns.Msg, reply *dns.Msg, ttl int, flags uint8, now
 // If no reply is stored in the cache, it returns a `nil` reply and no error. The caller can then `Wait()`
 // for another goroutine `Put`ing a reply in the cache.
 func (c *Cache) Get(request *dns.Msg, maxLen int, now time.Time) (reply *dns.Msg, err error) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
 	question := request.Question[0]
+	s := c.shardFor(question)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	key := cacheKey(question)
-	if ent, found := c.entries[key]; found {
+	if ent, found := s.entries[key]; found {
+		if ent.Status != stResolved {
+			c.metrics.pending.Inc()
+		}
+
+		if ent.Status == stResolved && ent.hasExpired(now) &&
+			c.ServeStaleFor > 0 && now.Sub(ent.validUntil) < c.ServeStaleFor {
+			if reply, err = ent.getStaleReply(request, maxLen, now, staleReplyTTL); reply != nil {
+				Debug.Printf("[cache msgid %d] serving stale while revalidating", request.MsgHdr.Id)
+				c.metrics.hits.Inc()
+				c.triggerRefresh(key, question)
+			}
+			return
+		}
+
 		reply, err = ent.getReply(request, maxLen, now)
 		if ent.hasExpired(now) {
 			Debug.Printf("[cache msgid %d] expired: removing", request.MsgHdr.Id)
 			if ent.index > 0 {
-				heap.Remove(&c.entriesH, ent.index)
+				heap.Remove(&s.entriesH, ent.index)
 			}
-			delete(c.entries, key)
+			delete(s.entries, key)
+			c.metrics.expiredEvictions.Inc()
+			c.metrics.size.Dec()
 			reply = nil
+		} else if reply != nil {
+			c.metrics.hits.Inc()
 		}
 	} else {
 		// we are the first asking for this name: create an entry with no reply... the caller must wait
 		Debug.Printf("[cache msgid %d] addind in pending state", request.MsgHdr.Id)
-		c.entries[key] = newCacheEntry(&question, now)
+		s.entries[key] = newCacheEntry(&question, now)
+		c.metrics.misses.Inc()
+		c.metrics.size.Inc()
 	}
 	return
 }
 
+// maxWaitReplyLen is the maxLen passed to getReply from Wait, which has no truncation
+// budget of its own to honour.
+const maxWaitReplyLen = math.MaxInt32
+
+// Wait blocks for the resolution of a question that Get reported as pending (i.e. Get
+// returned a nil reply and nil error). It wakes up as soon as some other goroutine Puts the
+// answer into the cache, turning the cache into a singleflight barrier so that N concurrent
+// lookups for the same question only trigger one upstream query. It gives up, returning
+// errTimeout, if ctx is cancelled or defPendingTimeout elapses first.
+func (c *Cache) Wait(ctx context.Context, request *dns.Msg, now time.Time) (*dns.Msg, error) {
+	question := request.Question[0]
+	s := c.shardFor(question)
+	key := cacheKey(question)
+
+	s.lock.RLock()
+	ent, found := s.entries[key]
+	s.lock.RUnlock()
+
+	if !found {
+		return nil, errCouldNotResolve
+	}
+
+	timeout := time.NewTimer(time.Second * time.Duration(defPendingTimeout))
+	defer timeout.Stop()
+
+	select {
+	case <-ent.ready:
+	case <-ctx.Done():
+		return nil, errTimeout
+	case <-timeout.C:
+		return nil, errTimeout
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return ent.getReply(request, maxWaitReplyLen, now)
+}
+
 // Remove removes the provided question from the cache.
 func (c *Cache) Remove(question *dns.Question) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	s := c.shardFor(*question)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	key := cacheKey(*question)
-	if entry, found := c.entries[key]; found {
+	if entry, found := s.entries[key]; found {
 		if entry.index > 0 {
-			heap.Remove(&c.entriesH, entry.index)
+			heap.Remove(&s.entriesH, entry.index)
 		}
-		delete(c.entries, key)
+		delete(s.entries, key)
+		c.metrics.size.Dec()
 	}
 }
 
-// Len returns the number of entries in the cache.
+// Len returns the number of entries in the cache, summed across all shards.
 func (c *Cache) Len() int {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	total := 0
+	for _, s := range c.shards {
+		s.lock.RLock()
+		total += len(s.entries)
+		s.lock.RUnlock()
+	}
+	return total
+}
 
-	return len(c.entries)
+// triggerRefresh kicks off an asynchronous refresh of key/question, unless one is already
+// in flight, so that concurrent stale hits only cause a single upstream lookup.
+func (c *Cache) triggerRefresh(key cacheKey, question dns.Question) {
+	if c.refresher == nil {
+		return
+	}
+
+	c.refreshLock.Lock()
+	if _, inFlight := c.refreshing[key]; inFlight {
+		c.refreshLock.Unlock()
+		return
+	}
+	c.refreshing[key] = struct{}{}
+	c.refreshLock.Unlock()
+
+	go c.refresh(key, question)
+}
+
+// refresh re-resolves question through the configured Refresher and stores the result in
+// the cache, extending validUntil instead on error so a flaky upstream isn't hammered.
+func (c *Cache) refresh(key cacheKey, question dns.Question) {
+	defer func() {
+		c.refreshLock.Lock()
+		delete(c.refreshing, key)
+		c.refreshLock.Unlock()
+	}()
+
+	reply, ttl, err := c.refresher(question)
+	now := time.Now()
+
+	s := c.shardFor(question)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ent, found := s.entries[key]
+	if !found {
+		return
+	}
+
+	if err != nil {
+		Debug.Printf("[cache] refresh of %s failed: %s; continuing to serve stale", question.Name, err)
+		ent.validUntil = now.Add(c.ServeStaleFor)
+		heap.Fix(&s.entriesH, ent.index)
+		return
+	}
+
+	c.observeReplacedAge(ent, now)
+	if ent.setReply(reply, ttl, ent.Flags, now, c.MaxNegativeTTL) {
+		heap.Fix(&s.entriesH, ent.index)
+	}
+}
+
+// observeReplacedAge records, in cache_entry_age_seconds, how long ent's current value has
+// been sitting in the cache right before it gets overwritten by a new resolution.
+func (c *Cache) observeReplacedAge(ent *cacheEntry, now time.Time) {
+	if ent.Status == stResolved {
+		c.metrics.entryAge.Observe(now.Sub(ent.putTime).Seconds())
+	}
 }
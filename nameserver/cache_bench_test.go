@@ -0,0 +1,60 @@
+package nameserver
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// makeBenchRequest builds a minimal request/reply pair for question index i, each under a
+// distinct name so that concurrent benchmark goroutines don't hit the same cache entry.
+func makeBenchRequest(i int) (*dns.Msg, *dns.Msg) {
+	name := fmt.Sprintf("host-%d.weave.local.", i)
+
+	request := new(dns.Msg)
+	request.SetQuestion(name, dns.TypeA)
+
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	reply.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+	}}
+
+	return request, reply
+}
+
+// benchmarkCacheConcurrentAccess runs many goroutines concurrently Put-ing and Get-ing
+// distinct questions, to compare lock contention between shard counts.
+func benchmarkCacheConcurrentAccess(b *testing.B, shards int) {
+	cache, err := NewCache(8192, CacheOptions{Shards: shards})
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now()
+	var counter int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(atomic.AddInt64(&counter, 1))
+			request, reply := makeBenchRequest(i)
+			cache.Put(request, reply, 60, 0, now)
+			cache.Get(request, 4096, now)
+		}
+	})
+}
+
+// BenchmarkCacheConcurrentAccessSingleShard approximates the pre-sharding behaviour: every
+// goroutine contends on the same lock and heap regardless of which question it touches.
+func BenchmarkCacheConcurrentAccessSingleShard(b *testing.B) {
+	benchmarkCacheConcurrentAccess(b, 1)
+}
+
+// BenchmarkCacheConcurrentAccessSharded exercises the default shard count, where distinct
+// questions usually land on different shards and stop contending with each other.
+func BenchmarkCacheConcurrentAccessSharded(b *testing.B) {
+	benchmarkCacheConcurrentAccess(b, defShardCount)
+}
@@ -0,0 +1,240 @@
+package nameserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// makeTestRequest builds a minimal request/reply pair for name, with a single A answer.
+func makeTestRequest(name string) (*dns.Msg, *dns.Msg) {
+	request := new(dns.Msg)
+	request.SetQuestion(name, dns.TypeA)
+
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	reply.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+	}}
+
+	return request, reply
+}
+
+func TestWaitUnblocksOnPut(t *testing.T) {
+	cache, err := NewCache(16, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	request, reply := makeTestRequest("wait-unblocks.weave.local.")
+
+	// First Get creates the pending entry, as if we were the first caller to ask.
+	if got, err := cache.Get(request, 4096, now); got != nil || err != nil {
+		t.Fatalf("expected (nil, nil) for a first lookup, got (%v, %v)", got, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cache.Put(request, reply, 60, 0, time.Now())
+	}()
+
+	got, err := cache.Wait(context.Background(), request, time.Now())
+	if err != nil {
+		t.Fatalf("Wait returned an error: %s", err)
+	}
+	if got == nil || len(got.Answer) != 1 {
+		t.Fatalf("expected the Put reply to be returned, got %v", got)
+	}
+}
+
+func TestWaitTimesOutOnContextCancel(t *testing.T) {
+	cache, err := NewCache(16, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	request, _ := makeTestRequest("wait-ctx-timeout.weave.local.")
+
+	if got, err := cache.Get(request, 4096, now); got != nil || err != nil {
+		t.Fatalf("expected (nil, nil) for a first lookup, got (%v, %v)", got, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = cache.Wait(ctx, request, time.Now())
+	if err != errTimeout {
+		t.Fatalf("expected errTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Wait should have returned as soon as the context was cancelled, took %s", elapsed)
+	}
+}
+
+func TestWaitTimesOutOnPendingTimeout(t *testing.T) {
+	cache, err := NewCache(16, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	request, _ := makeTestRequest("wait-pending-timeout.weave.local.")
+
+	if got, err := cache.Get(request, 4096, now); got != nil || err != nil {
+		t.Fatalf("expected (nil, nil) for a first lookup, got (%v, %v)", got, err)
+	}
+
+	// Nobody ever Puts a reply: Wait must give up on its own after defPendingTimeout.
+	_, err = cache.Wait(context.Background(), request, time.Now())
+	if err != errTimeout {
+		t.Fatalf("expected errTimeout, got %v", err)
+	}
+}
+
+func TestStaleServeThenRefresh(t *testing.T) {
+	refreshed := make(chan struct{})
+	request, reply := makeTestRequest("stale.weave.local.")
+
+	cache, err := NewCache(16, CacheOptions{
+		ServeStaleFor: time.Hour,
+		Refresher: func(q dns.Question) (*dns.Msg, int, error) {
+			_, freshReply := makeTestRequest(q.Name)
+			close(refreshed)
+			return freshReply, 60, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now()
+	cache.Put(request, reply, 1, 0, base) // valid for 1 second from base
+
+	// Ask again once the entry has expired, but still within ServeStaleFor.
+	staleNow := base.Add(2 * time.Second)
+	got, err := cache.Get(request, 4096, staleNow)
+	if err != nil {
+		t.Fatalf("Get returned an error while serving stale: %s", err)
+	}
+	if got == nil || len(got.Answer) != 1 {
+		t.Fatalf("expected a stale reply, got %v", got)
+	}
+	if ttl := got.Answer[0].Header().Ttl; ttl != staleReplyTTL {
+		t.Errorf("expected the stale reply TTL to be clamped to %d, got %d", staleReplyTTL, ttl)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("serving a stale reply should have triggered a background refresh")
+	}
+}
+
+func TestRefreshClearsStaleCacheNegativeFlag(t *testing.T) {
+	request, negReply := makeTestRequest("poisoned.weave.local.")
+	negReply.Rcode = dns.RcodeNameError
+
+	cache, err := NewCache(16, CacheOptions{
+		ServeStaleFor: time.Hour,
+		Refresher: func(q dns.Question) (*dns.Msg, int, error) {
+			_, freshReply := makeTestRequest(q.Name)
+			return freshReply, 60, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now()
+	cache.Put(request, negReply, 1, 0, base) // cached as a negative (NXDOMAIN) reply
+
+	// Trigger the background refresh by asking once the entry has gone stale.
+	staleNow := base.Add(2 * time.Second)
+	if _, err := cache.Get(request, 4096, staleNow); err != errNegativeReply {
+		t.Fatalf("expected the stale NXDOMAIN reply to surface errNegativeReply, got %v", err)
+	}
+
+	// Once the async refresh lands its positive answer, the stale CacheNegative flag must
+	// not stick around: it should not be forwarded into the refreshed entry.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if got, err := cache.Get(request, 4096, staleNow); got != nil && err == nil {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("refreshed positive reply still reports errNegativeReply")
+}
+
+func TestNegativeTTLCappedBySOA(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Rrtype: dns.TypeSOA, Ttl: 500},
+		Minttl: 1000,
+	}
+	reply := new(dns.Msg)
+	reply.Ns = []dns.RR{soa}
+
+	if ttl := negativeTTL(reply, 100); ttl != 100 {
+		t.Errorf("expected the negative TTL to be capped at 100, got %d", ttl)
+	}
+	if ttl := negativeTTL(reply, 10000); ttl != 500 {
+		t.Errorf("expected the negative TTL to be min(SOA.Ttl, SOA.Minttl) = 500, got %d", ttl)
+	}
+
+	noSOA := new(dns.Msg)
+	if ttl := negativeTTL(noSOA, 42); ttl != 42 {
+		t.Errorf("expected maxNegativeTTL as a fallback when no SOA is present, got %d", ttl)
+	}
+}
+
+func TestNewCacheRoundsUpPerShardCapacity(t *testing.T) {
+	cache, err := NewCache(10, CacheOptions{Shards: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cache.shards) != 3 {
+		t.Fatalf("expected 3 shards, got %d", len(cache.shards))
+	}
+	for i, s := range cache.shards {
+		if s.capacity != 4 {
+			t.Errorf("shard %d: expected capacity 4 (ceil(10/3)), got %d", i, s.capacity)
+		}
+	}
+}
+
+func TestMetricsHitsMissesPending(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	cache, err := NewCache(16, CacheOptions{MetricsRegisterer: registry})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	request, reply := makeTestRequest("metrics.weave.local.")
+
+	// First lookup: miss, and a pending entry is created.
+	cache.Get(request, 4096, now)
+	if got := testutil.ToFloat64(cache.metrics.misses); got != 1 {
+		t.Errorf("expected 1 miss, got %v", got)
+	}
+
+	// Second lookup while still pending.
+	cache.Get(request, 4096, now)
+	if got := testutil.ToFloat64(cache.metrics.pending); got != 1 {
+		t.Errorf("expected 1 pending lookup, got %v", got)
+	}
+
+	cache.Put(request, reply, 60, 0, now)
+	cache.Get(request, 4096, now)
+	if got := testutil.ToFloat64(cache.metrics.hits); got != 1 {
+		t.Errorf("expected 1 hit, got %v", got)
+	}
+}